@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// defaultBlobSourceHistorySize bounds how many source repositories are remembered per digest,
+// mirroring the layered "blobsum" mapping the Docker daemon keeps for each layer digest.
+const defaultBlobSourceHistorySize = 50
+
+// blobSourceStoreStripes bounds the number of per-digest locks BlobSourceStore stripes its
+// read-modify-write sequence across. A single process-wide lock would serialize every Stat's
+// source-store lookup/record behind one mutex even while the storage driver does network I/O,
+// undoing the concurrency chunk0-2 added to candidate probing; striping lets unrelated digests
+// proceed in parallel while still serializing read-modify-write for the *same* digest.
+const blobSourceStoreStripes = 64
+
+// blobSourceEntry records one remote repository that was seen serving a particular digest.
+type blobSourceEntry struct {
+	Repository string    `json:"repository"`
+	Insecure   bool      `json:"insecure"`
+	LastSeen   time.Time `json:"lastSeen"`
+}
+
+// BlobSourceStore persists, per digest, the remote repositories recently known to hold it. Unlike
+// the in-memory TTL cache on repository.cachedLayers, it survives registry restarts by storing one
+// small JSON record per digest through the registry's storage driver.
+type BlobSourceStore struct {
+	driver      storagedriver.StorageDriver
+	maxPerDigst int
+
+	// stripes guards the read-modify-write sequence in Record, one lock per stripe rather than one
+	// lock for the whole store, so concurrent Stat calls for different digests don't serialize
+	// behind each other's storage-driver I/O.
+	stripes [blobSourceStoreStripes]sync.Mutex
+}
+
+// NewBlobSourceStore returns a store persisting through driver. maxPerDigest bounds how many
+// repositories are kept per digest; defaultBlobSourceHistorySize is used when it is <= 0.
+func NewBlobSourceStore(driver storagedriver.StorageDriver, maxPerDigest int) *BlobSourceStore {
+	if maxPerDigest <= 0 {
+		maxPerDigest = defaultBlobSourceHistorySize
+	}
+	return &BlobSourceStore{driver: driver, maxPerDigst: maxPerDigest}
+}
+
+func blobSourceStorePath(dgst digest.Digest) string {
+	return path.Join("/dockerregistry/blobsourcestore", string(dgst.Algorithm()), dgst.Hex()+".json")
+}
+
+// stripeFor returns the lock guarding dgst's record, deterministically hashed across
+// blobSourceStoreStripes so the same digest always maps to the same stripe.
+func (s *BlobSourceStore) stripeFor(dgst digest.Digest) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(dgst.String()))
+	return &s.stripes[h.Sum32()%blobSourceStoreStripes]
+}
+
+// Repositories returns the repositories previously recorded for dgst in the order they are stored,
+// which is not sorted by LastSeen.
+func (s *BlobSourceStore) Repositories(ctx context.Context, dgst digest.Digest) ([]blobSourceEntry, error) {
+	lock := s.stripeFor(dgst)
+	lock.Lock()
+	defer lock.Unlock()
+	return s.readLocked(ctx, dgst)
+}
+
+func (s *BlobSourceStore) readLocked(ctx context.Context, dgst digest.Digest) ([]blobSourceEntry, error) {
+	data, err := s.driver.GetContent(ctx, blobSourceStorePath(dgst))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []blobSourceEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// isRepositoryLiveFunc reports whether repository is still referenced by a live image stream known
+// to the caller. Callers can only see the image stream(s) they have in hand (e.g. the one being
+// resolved by the current Stat call) — a "false" here means "not live for what this caller can see",
+// not "dead everywhere". trimBlobSourceHistory accounts for that by treating it as a tiebreaker
+// rather than an absolute eviction order, since a repository invisible to one stream may well still
+// be live for another; LastSeen itself (refreshed by any stream that still resolves through it) is
+// the only signal that's actually global.
+type isRepositoryLiveFunc func(repository string) bool
+
+// Record notes that repository served dgst, refreshing its LastSeen if already present. When the
+// history for dgst exceeds the store's cap, the least recently seen entries are dropped first;
+// isLive only breaks ties among entries seen within blobSourceHistoryTieWindow of each other.
+func (s *BlobSourceStore) Record(ctx context.Context, dgst digest.Digest, repository string, insecure bool, isLive isRepositoryLiveFunc) error {
+	lock := s.stripeFor(dgst)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entries, err := s.readLocked(ctx, dgst)
+	if err != nil {
+		context.GetLogger(ctx).Errorf("blobsourcestore: failed to read existing entries for %q: %v", dgst, err)
+		entries = nil
+	}
+
+	now := time.Now()
+	found := false
+	for i := range entries {
+		if entries[i].Repository == repository {
+			entries[i].LastSeen = now
+			entries[i].Insecure = insecure
+			found = true
+			break
+		}
+	}
+	if !found {
+		entries = append(entries, blobSourceEntry{Repository: repository, Insecure: insecure, LastSeen: now})
+	}
+
+	entries = trimBlobSourceHistory(entries, s.maxPerDigst, isLive)
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return s.driver.PutContent(ctx, blobSourceStorePath(dgst), data)
+}
+
+// blobSourceHistoryTieWindow bounds how close two entries' LastSeen must be before isLive is
+// consulted to break the tie. isLive only reflects what the current caller can see, so it must
+// never override a clearly fresher LastSeen from some other stream recording the same repository.
+const blobSourceHistoryTieWindow = time.Minute
+
+// trimBlobSourceHistory drops entries until len(entries) <= max, evicting the least recently seen
+// entries first. isLive is consulted only to break ties between entries seen within
+// blobSourceHistoryTieWindow of each other, preferring to evict the one it reports dead.
+func trimBlobSourceHistory(entries []blobSourceEntry, max int, isLive isRepositoryLiveFunc) []blobSourceEntry {
+	if len(entries) <= max {
+		return entries
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		ti, tj := entries[i].LastSeen, entries[j].LastSeen
+		if diff := ti.Sub(tj); diff > -blobSourceHistoryTieWindow && diff < blobSourceHistoryTieWindow && isLive != nil {
+			iDead := !isLive(entries[i].Repository)
+			jDead := !isLive(entries[j].Repository)
+			if iDead != jDead {
+				// dead entries sort first, so they're trimmed off before their near-equally-stale peer
+				return iDead
+			}
+		}
+		return ti.Before(tj)
+	})
+
+	return append([]blobSourceEntry(nil), entries[len(entries)-max:]...)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestBlobSourceStoreStripeForIsDeterministic(t *testing.T) {
+	s := &BlobSourceStore{}
+	dgst := digest.Digest("sha256:ffff")
+
+	first := s.stripeFor(dgst)
+	for i := 0; i < 10; i++ {
+		if got := s.stripeFor(dgst); got != first {
+			t.Fatalf("stripeFor(%q) returned different locks across calls", dgst)
+		}
+	}
+}
+
+func TestTrimBlobSourceHistoryDropsLeastRecentlySeen(t *testing.T) {
+	now := time.Now()
+	entries := []blobSourceEntry{
+		{Repository: "oldest", LastSeen: now.Add(-3 * time.Hour)},
+		{Repository: "middle", LastSeen: now.Add(-2 * time.Hour)},
+		{Repository: "newest", LastSeen: now.Add(-1 * time.Hour)},
+	}
+
+	got := trimBlobSourceHistory(entries, 2, nil)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(got))
+	}
+	for _, e := range got {
+		if e.Repository == "oldest" {
+			t.Errorf("expected the oldest entry to be trimmed, but it survived")
+		}
+	}
+}
+
+func TestTrimBlobSourceHistoryUsesIsLiveOnlyAsTiebreaker(t *testing.T) {
+	now := time.Now()
+	// "dead" is reported not-live by isLive, but it was seen more recently than "live" was. A caller
+	// can only observe liveness for the repositories it knows about, so isLive must not override a
+	// clearly fresher LastSeen - it only breaks ties among equally-stale entries.
+	entries := []blobSourceEntry{
+		{Repository: "dead", LastSeen: now},
+		{Repository: "live", LastSeen: now.Add(-time.Hour)},
+	}
+
+	isLive := func(repository string) bool { return repository == "live" }
+
+	got := trimBlobSourceHistory(entries, 1, isLive)
+	if len(got) != 1 || got[0].Repository != "dead" {
+		t.Fatalf("expected the more recently seen entry to survive regardless of isLive, got %+v", got)
+	}
+}
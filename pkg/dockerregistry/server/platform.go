@@ -0,0 +1,161 @@
+package server
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+)
+
+// PlatformSelector identifies which platform's blobs should be resolved when
+// a tag or digest turns out to reference a manifest list / OCI image index.
+// It mirrors the OCI platform matcher semantics used by containerd: OS and
+// Architecture must match exactly, while an empty Variant matches any
+// candidate variant.
+type PlatformSelector struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// Matches reports whether candidate is an acceptable match for sel.
+func (sel PlatformSelector) Matches(candidate manifestlist.PlatformSpec) bool {
+	if sel.OS != candidate.OS || sel.Architecture != candidate.Architecture {
+		return false
+	}
+	if sel.Variant == "" || candidate.Variant == "" {
+		return true
+	}
+	return sel.Variant == candidate.Variant
+}
+
+// hostPlatformSelector returns a selector for the platform the registry
+// process itself is running on, used as a fallback when no selector is
+// attached to the context and no server default is configured.
+func hostPlatformSelector() PlatformSelector {
+	return PlatformSelector{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+type platformSelectorContextKey struct{}
+
+// WithPlatformSelector returns a context that carries sel, causing Stat,
+// Open and ServeBlob to resolve manifest lists against it rather than the
+// host platform or the first listed entry.
+func WithPlatformSelector(ctx context.Context, sel PlatformSelector) context.Context {
+	return context.WithValue(ctx, platformSelectorContextKey{}, sel)
+}
+
+// PlatformSelectorFrom returns the PlatformSelector attached to ctx, if any.
+func PlatformSelectorFrom(ctx context.Context) (PlatformSelector, bool) {
+	sel, ok := ctx.Value(platformSelectorContextKey{}).(PlatformSelector)
+	return sel, ok
+}
+
+// manifestListResolver caches, per parent manifest-list digest, the child
+// manifest digest chosen for a given platform so repeat blob requests for
+// the same tag don't re-fetch and re-walk the list. It also remembers digests
+// that turned out not to be manifest lists at all, so a repeated lookup for
+// the same non-list digest doesn't pay for another Manifests().Get() round trip.
+type manifestListResolver struct {
+	mu      sync.Mutex
+	cache   map[digest.Digest]digest.Digest
+	notList map[digest.Digest]struct{}
+}
+
+func newManifestListResolver() *manifestListResolver {
+	return &manifestListResolver{
+		cache:   make(map[digest.Digest]digest.Digest),
+		notList: make(map[digest.Digest]struct{}),
+	}
+}
+
+func (r *manifestListResolver) lookup(parent digest.Digest) (digest.Digest, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	child, ok := r.cache[parent]
+	return child, ok
+}
+
+func (r *manifestListResolver) isKnownNotList(dgst digest.Digest) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.notList[dgst]
+	return ok
+}
+
+func (r *manifestListResolver) remember(parent, child digest.Digest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache[parent] = child
+}
+
+func (r *manifestListResolver) rememberNotList(dgst digest.Digest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notList[dgst] = struct{}{}
+}
+
+// resolvePlatformManifest resolves dgst to the digest of the child manifest matching sel, if dgst
+// identifies a manifest list / OCI image index in repo. If dgst does not identify a manifest list
+// (or the manifest service returns an error), ok is false and the caller should proceed with dgst
+// unchanged.
+func (rbs *remoteBlobGetterService) resolvePlatformManifest(ctx context.Context, repo distribution.Repository, dgst digest.Digest, sel PlatformSelector) (digest.Digest, bool) {
+	resolver := rbs.platformManifestResolver()
+	if chosen, ok := resolver.lookup(dgst); ok {
+		return chosen, true
+	}
+	if resolver.isKnownNotList(dgst) {
+		return "", false
+	}
+
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return "", false
+	}
+
+	manifest, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return "", false
+	}
+
+	list, ok := manifest.(*manifestlist.DeserializedManifestList)
+	if !ok {
+		resolver.rememberNotList(dgst)
+		return "", false
+	}
+
+	chosen := chooseManifestForPlatform(list.Manifests, sel)
+	if chosen == "" {
+		return "", false
+	}
+
+	resolver.remember(dgst, chosen)
+	return chosen, true
+}
+
+// chooseManifestForPlatform picks the descriptor matching sel, falling back to the host platform
+// and then to the first entry, matching the fallback order described for pull-through resolution.
+func chooseManifestForPlatform(descriptors []manifestlist.ManifestDescriptor, sel PlatformSelector) digest.Digest {
+	if len(descriptors) == 0 {
+		return ""
+	}
+
+	for _, d := range descriptors {
+		if sel.Matches(d.Platform) {
+			return d.Digest
+		}
+	}
+
+	if host := hostPlatformSelector(); host != sel {
+		for _, d := range descriptors {
+			if host.Matches(d.Platform) {
+				return d.Digest
+			}
+		}
+	}
+
+	return descriptors[0].Digest
+}
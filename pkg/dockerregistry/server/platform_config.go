@@ -0,0 +1,10 @@
+package server
+
+// PlatformConfig exposes the default platform used to resolve manifest lists
+// when a pull carries no PlatformSelector on its context, such as an
+// anonymous pull against the integrated registry.
+type PlatformConfig struct {
+	// Default is the platform assumed for anonymous pulls. When unset, the
+	// host platform the registry process runs on is used instead.
+	Default PlatformSelector
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+)
+
+func TestPlatformSelectorMatches(t *testing.T) {
+	sel := PlatformSelector{OS: "linux", Architecture: "arm64", Variant: "v8"}
+
+	tests := []struct {
+		name      string
+		candidate manifestlist.PlatformSpec
+		want      bool
+	}{
+		{"exact match", manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64", Variant: "v8"}, true},
+		{"different os", manifestlist.PlatformSpec{OS: "windows", Architecture: "arm64", Variant: "v8"}, false},
+		{"different arch", manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64", Variant: "v8"}, false},
+		{"candidate has no variant", manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64"}, true},
+		{"different variant", manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64", Variant: "v7"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sel.Matches(tt.candidate); got != tt.want {
+				t.Errorf("Matches(%+v) = %v, want %v", tt.candidate, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChooseManifestForPlatformFallsBackToFirstEntry(t *testing.T) {
+	descriptors := []manifestlist.ManifestDescriptor{
+		{Platform: manifestlist.PlatformSpec{OS: "windows", Architecture: "amd64"}},
+		{Platform: manifestlist.PlatformSpec{OS: "linux", Architecture: "ppc64le"}},
+	}
+	descriptors[0].Digest = digest.Digest("sha256:aaaa")
+	descriptors[1].Digest = digest.Digest("sha256:bbbb")
+
+	sel := PlatformSelector{OS: "darwin", Architecture: "amd64"}
+	got := chooseManifestForPlatform(descriptors, sel)
+	if got != descriptors[0].Digest {
+		t.Errorf("expected fallback to first entry %q, got %q", descriptors[0].Digest, got)
+	}
+}
+
+func TestChooseManifestForPlatformPrefersExactMatch(t *testing.T) {
+	descriptors := []manifestlist.ManifestDescriptor{
+		{Platform: manifestlist.PlatformSpec{OS: "windows", Architecture: "amd64"}},
+		{Platform: manifestlist.PlatformSpec{OS: "linux", Architecture: "ppc64le"}},
+	}
+	descriptors[0].Digest = digest.Digest("sha256:aaaa")
+	descriptors[1].Digest = digest.Digest("sha256:bbbb")
+
+	sel := PlatformSelector{OS: "linux", Architecture: "ppc64le"}
+	got := chooseManifestForPlatform(descriptors, sel)
+	if got != descriptors[1].Digest {
+		t.Errorf("expected exact match %q, got %q", descriptors[1].Digest, got)
+	}
+}
+
+func TestManifestListResolverCachesNotListNegatives(t *testing.T) {
+	r := newManifestListResolver()
+	dgst := digest.Digest("sha256:cccc")
+
+	if r.isKnownNotList(dgst) {
+		t.Fatalf("expected %q to not be known yet", dgst)
+	}
+	r.rememberNotList(dgst)
+	if !r.isKnownNotList(dgst) {
+		t.Fatalf("expected %q to be remembered as not a list", dgst)
+	}
+}
+
+func TestContextForManifestResolutionAppliesDefaultPlatform(t *testing.T) {
+	rbs := &remoteBlobGetterService{defaultPlatform: PlatformSelector{OS: "linux", Architecture: "s390x"}}
+
+	ctx := rbs.contextForManifestResolution(context.Background())
+	sel, ok := PlatformSelectorFrom(ctx)
+	if !ok || sel != rbs.defaultPlatform {
+		t.Fatalf("expected defaultPlatform %+v to be attached, got %+v (ok=%v)", rbs.defaultPlatform, sel, ok)
+	}
+}
+
+func TestContextForManifestResolutionPreservesExistingSelector(t *testing.T) {
+	rbs := &remoteBlobGetterService{defaultPlatform: PlatformSelector{OS: "linux", Architecture: "s390x"}}
+	explicit := PlatformSelector{OS: "windows", Architecture: "amd64"}
+
+	ctx := rbs.contextForManifestResolution(WithPlatformSelector(context.Background(), explicit))
+	sel, ok := PlatformSelectorFrom(ctx)
+	if !ok || sel != explicit {
+		t.Fatalf("expected caller-supplied selector %+v to survive unchanged, got %+v (ok=%v)", explicit, sel, ok)
+	}
+}
+
+// TestPlatformManifestResolverConcurrentInit exercises the sync.Once-guarded lazy
+// initialization added to fix a race when proxyStat is invoked from several
+// concurrent candidate probes at once (see findCandidateRepository).
+func TestPlatformManifestResolverConcurrentInit(t *testing.T) {
+	rbs := &remoteBlobGetterService{}
+
+	const n = 16
+	results := make(chan *manifestListResolver, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			results <- rbs.platformManifestResolver()
+		}()
+	}
+
+	first := <-results
+	for i := 1; i < n; i++ {
+		if got := <-results; got != first {
+			t.Fatalf("platformManifestResolver() returned distinct instances across goroutines")
+		}
+	}
+}
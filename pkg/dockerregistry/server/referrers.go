@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+
+	"k8s.io/kubernetes/pkg/api/errors"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+	"github.com/openshift/origin/pkg/image/importer"
+)
+
+// referrersTagFallback builds the tag-schema fallback used by registries that don't yet implement
+// the dedicated /referrers API: a tag of the form "<algorithm>-<hex>" whose manifest is an OCI
+// index listing the subject's referrers. This is the only mechanism available through the vendored
+// distribution client, which predates the dedicated endpoint.
+func referrersTagFallback(subject digest.Digest) string {
+	return fmt.Sprintf("%s-%s", subject.Algorithm(), subject.Hex())
+}
+
+// Referrers returns the descriptors of every artifact referring to subject (optionally filtered to
+// artifactType), aggregated across every remote repository that mirrors this image stream. It
+// implements pull-through support for `GET /v2/<name>/referrers/<digest>` so cosign signatures,
+// notary attestations and SBOMs attached to a pulled-through image can be discovered without the
+// caller knowing which upstream mirror originally served it. Candidate repositories are probed
+// concurrently, the same way Stat probes them for blobs.
+func (rbs *remoteBlobGetterService) Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]distribution.Descriptor, error) {
+	is, err := rbs.repo.getImageStream()
+	if err != nil {
+		if errors.IsNotFound(err) || errors.IsForbidden(err) {
+			return nil, nil
+		}
+		context.GetLogger(ctx).Errorf("Error retrieving image stream for referrers: %v", err)
+		return nil, err
+	}
+
+	var localRegistry string
+	if local, err := imageapi.ParseDockerImageReference(is.Status.DockerImageRepository); err == nil {
+		localRegistry = local.Registry
+	}
+	var pullFromInsecureRegistries bool
+	if insecure, ok := is.Annotations[imageapi.InsecureRepositoryAnnotation]; ok {
+		pullFromInsecureRegistries = insecure == "true"
+	}
+
+	search := rbs.identifyCandidateRepositories(is, localRegistry, true)
+	secondary := rbs.identifyCandidateRepositories(is, localRegistry, false)
+	for repo, ref := range secondary {
+		if _, ok := search[repo]; !ok {
+			search[repo] = ref
+		}
+	}
+
+	retriever := rbs.repo.importContext()
+
+	type referrersResult struct {
+		repo  string
+		descs []distribution.Descriptor
+		bs    distribution.BlobStore
+	}
+
+	results := make(chan referrersResult, len(search))
+	sem := make(chan struct{}, rbs.maxCandidateProbeWorkers())
+
+	var wg sync.WaitGroup
+	for repo, ref := range search {
+		wg.Add(1)
+		go func(repo string, ref *imageapi.DockerImageReference) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			descs, bs, err := rbs.fetchReferrers(ctx, retriever, *ref, subject, artifactType, pullFromInsecureRegistries)
+			if err != nil {
+				context.GetLogger(ctx).Infof("Referrers: no referrers for %q found in %q: %v", subject, repo, err)
+				return
+			}
+			results <- referrersResult{repo: repo, descs: descs, bs: bs}
+		}(repo, ref)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	seen := make(map[digest.Digest]struct{})
+	var merged []distribution.Descriptor
+	for res := range results {
+		for _, desc := range res.descs {
+			if _, ok := seen[desc.Digest]; ok {
+				continue
+			}
+			seen[desc.Digest] = struct{}{}
+			merged = append(merged, desc)
+
+			rbs.storeMu.Lock()
+			rbs.digestToStore[desc.Digest.String()] = res.bs
+			rbs.storeMu.Unlock()
+		}
+	}
+
+	return merged, nil
+}
+
+// fetchReferrers resolves ref's repository through retriever (so auth, TLS and proxy settings match
+// every other pull-through code path) and looks up the referrers of subject via the tag-schema
+// fallback manifest. On success it also returns the distribution.BlobStore backing ref's repository
+// so callers can cache it for a later Open/ServeBlob without re-probing.
+//
+// Known scope cut: this does not call the primary upstream GET /v2/<name>/referrers/<digest>
+// endpoint before falling back to the tag schema. distribution.Repository (the interface retriever
+// hands back, and the only client this package uses in order to keep auth/TLS consistent with every
+// other pull-through path - see the chunk0-5 review fix that removed a hand-rolled unauthenticated
+// HTTP path for this same reason) has no method for it: the vendored client predates OCI 1.1 and
+// exposes no way to issue that request through the authenticated transport it already built. Adding
+// one would mean either reimplementing raw HTTP outside that authenticated client - reintroducing
+// the auth bug already fixed once - or upgrading the vendored distribution client, which is out of
+// scope here. The tag-schema fallback is implemented in full; the direct endpoint is an intentional
+// follow-up, not an oversight.
+func (rbs *remoteBlobGetterService) fetchReferrers(ctx context.Context, retriever importer.RepositoryRetriever, ref imageapi.DockerImageReference, subject digest.Digest, artifactType string, insecure bool) ([]distribution.Descriptor, distribution.BlobStore, error) {
+	repo, err := retriever.Repository(ctx, ref.RegistryURL(), ref.RepositoryName(), insecure)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tags := repo.Tags(ctx)
+	tagDesc, err := tags.Get(ctx, referrersTagFallback(subject))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest, err := manifests.Get(ctx, tagDesc.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	list, ok := manifest.(*manifestlist.DeserializedManifestList)
+	if !ok {
+		return nil, nil, fmt.Errorf("referrers manifest for %q in %q is not an OCI index", subject, ref.Exact())
+	}
+
+	// manifestlist.ManifestDescriptor (the vendored pre-OCI-1.1 type) carries no ArtifactType field;
+	// the closest match filtering by artifactType can do against it is the descriptor's MediaType.
+	var descs []distribution.Descriptor
+	for _, m := range list.Manifests {
+		if artifactType != "" && m.MediaType != artifactType {
+			continue
+		}
+		descs = append(descs, m.Descriptor)
+	}
+
+	return descs, repo.Blobs(ctx), nil
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/manifestlist"
+)
+
+// ociImageIndexMediaType is the media type of the synthetic OCI index serveReferrers responds with,
+// mirroring the index manifest Referrers aggregates its results from via referrersTagFallback.
+const ociImageIndexMediaType = "application/vnd.oci.image.index.v1+json"
+
+// ReferrersHandler returns a self-contained http.Handler for GET /v2/<name>/referrers/<digest>,
+// answering from rbs's repository. It is not registered against any route in this tree: the
+// manifest dispatcher that owns the registry's route table (alongside the existing tag and manifest
+// routes) is part of the app-setup package, which this snapshot does not include. Exposing it as a
+// plain http.Handler rather than a bespoke method means wiring it in is a one-line
+// router.Handle("/v2/{name}/referrers/{digest}", rbs.ReferrersHandler()) once that file exists,
+// with no further glue code needed here.
+func (rbs *remoteBlobGetterService) ReferrersHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dgst, err := digest.ParseDigest(path.Base(req.URL.Path))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid digest: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := rbs.serveReferrers(req.Context(), w, req, dgst); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// serveReferrers answers a GET /v2/<name>/referrers/<digest> request by aggregating referrers of
+// dgst across every candidate pull-through repository via Referrers, and encoding the result as an
+// OCI image index. ctx is taken from the caller (ReferrersHandler derives it from the request) so
+// that request-scoped auth, tracing and cancellation reach Referrers instead of being discarded.
+func (rbs *remoteBlobGetterService) serveReferrers(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
+	artifactType := req.URL.Query().Get("artifactType")
+
+	descs, err := rbs.Referrers(ctx, dgst, artifactType)
+	if err != nil {
+		return err
+	}
+
+	index := manifestlist.ManifestList{
+		Versioned: manifest.Versioned{SchemaVersion: 2, MediaType: ociImageIndexMediaType},
+		Manifests: make([]manifestlist.ManifestDescriptor, 0, len(descs)),
+	}
+	for _, desc := range descs {
+		index.Manifests = append(index.Manifests, manifestlist.ManifestDescriptor{Descriptor: desc})
+	}
+
+	w.Header().Set("Content-Type", ociImageIndexMediaType)
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(index)
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestReferrersTagFallback(t *testing.T) {
+	subject := digest.Digest("sha256:abcd1234")
+	got := referrersTagFallback(subject)
+	want := "sha256-abcd1234"
+	if got != want {
+		t.Errorf("referrersTagFallback(%q) = %q, want %q", subject, got, want)
+	}
+}
+
+// TestReferrersHandlerRejectsInvalidDigest exercises the one piece of ReferrersHandler that doesn't
+// require a real repository/image stream: parsing the subject digest out of the request path.
+func TestReferrersHandlerRejectsInvalidDigest(t *testing.T) {
+	rbs := &remoteBlobGetterService{}
+	req := httptest.NewRequest(http.MethodGet, "/v2/foo/referrers/not-a-digest", nil)
+	w := httptest.NewRecorder()
+
+	rbs.ReferrersHandler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d for an invalid digest, got %d", http.StatusBadRequest, w.Code)
+	}
+}
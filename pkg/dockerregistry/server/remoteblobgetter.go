@@ -2,6 +2,9 @@ package server
 
 import (
 	"net/http"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/context"
@@ -13,19 +16,117 @@ import (
 	"github.com/openshift/origin/pkg/image/importer"
 )
 
+// defaultCandidateProbeWorkers bounds how many candidate repositories are
+// probed with a concurrent proxyStat call during Stat.
+const defaultCandidateProbeWorkers = 8
+
 // BlobGetterService combines the operations to access and read blobs.
 type BlobGetterService interface {
 	distribution.BlobStatter
 	distribution.BlobProvider
 	distribution.BlobServer
+
+	// Referrers returns the descriptors of artifacts referring to subject, optionally filtered to
+	// artifactType, aggregating results from every remote repository pulled through for this image
+	// stream.
+	Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]distribution.Descriptor, error)
 }
 
 // remoteBlobGetterService implements BlobGetterService and allows to serve blobs from remote
 // repositories.
 type remoteBlobGetterService struct {
-	repo                       *repository
-	digestToStore              map[string]distribution.BlobStore
-	pullFromInsecureRegistries bool
+	repo *repository
+
+	// storeMu guards digestToStore, which is written concurrently by Stat
+	// when it fans out proxyStat calls across candidate repositories.
+	storeMu       sync.Mutex
+	digestToStore map[string]distribution.BlobStore
+
+	// scheduler, when set, is used to queue pulled-through blobs for eventual
+	// eviction from local storage. It may be nil if pull-through eviction is
+	// disabled for this registry.
+	scheduler *pullThroughScheduler
+	// blobTTL is how long a pulled-through blob is kept locally after it was
+	// last served before the scheduler removes it.
+	blobTTL time.Duration
+
+	// candidateProbeWorkers bounds the number of candidate repositories
+	// probed concurrently during Stat. Defaults to defaultCandidateProbeWorkers
+	// when zero.
+	candidateProbeWorkers int
+
+	// manifestLists caches, per manifest-list digest, the child manifest chosen
+	// for a platform so repeat blob requests short-circuit the list walk.
+	// manifestListsOnce guards its lazy initialization: proxyStat runs on a
+	// concurrent worker pool (see findCandidateRepository), so two probes
+	// racing on the first call must not race-initialize this field.
+	manifestListsOnce sync.Once
+	manifestLists     *manifestListResolver
+
+	// defaultPlatform is applied by contextForManifestResolution when the request context carries no
+	// PlatformSelector, e.g. anonymous pulls. Configured via PlatformConfig; defaults to the host
+	// platform when unset.
+	defaultPlatform PlatformSelector
+
+	// sourceStore, when set, persists the digest->source-repository history across
+	// restarts so cold Stat calls don't have to re-scan every candidate repository.
+	sourceStore *BlobSourceStore
+}
+
+// platformManifestResolver returns rbs.manifestLists, lazily initializing it exactly once so
+// callers constructed without it (e.g. in existing tests) still get working platform resolution,
+// even when called concurrently from multiple proxyStat workers.
+func (rbs *remoteBlobGetterService) platformManifestResolver() *manifestListResolver {
+	rbs.manifestListsOnce.Do(func() {
+		if rbs.manifestLists == nil {
+			rbs.manifestLists = newManifestListResolver()
+		}
+	})
+	return rbs.manifestLists
+}
+
+// contextForManifestResolution attaches rbs.defaultPlatform (or the host platform, if unset) to ctx
+// when the caller hasn't already set a PlatformSelector. Callers resolving a manifest or tag digest
+// that might be a manifest list should wrap their context with this before calling Stat/Open/
+// ServeBlob; the generic blob-probe path in proxyStat intentionally does not do this itself, since
+// applying it unconditionally would add a manifest-list lookup to every ordinary layer blob probe.
+func (rbs *remoteBlobGetterService) contextForManifestResolution(ctx context.Context) context.Context {
+	if _, ok := PlatformSelectorFrom(ctx); ok {
+		return ctx
+	}
+	sel := rbs.defaultPlatform
+	if sel == (PlatformSelector{}) {
+		sel = hostPlatformSelector()
+	}
+	return WithPlatformSelector(ctx, sel)
+}
+
+// StatManifest resolves dgst as a manifest or tag digest rather than a plain layer blob, applying
+// contextForManifestResolution so rbs.defaultPlatform (configured via PlatformConfig, e.g. for
+// anonymous pulls with no client-supplied platform) takes effect. The registry's manifest-by-digest
+// handler should call this instead of Stat directly: Stat leaves manifest-list resolution opt-in so
+// the common layer-blob probe doesn't pay for an extra Manifests().Get() round trip, and a caller
+// that already knows it's resolving a manifest is the one place that cost is worth paying
+// unconditionally.
+func (rbs *remoteBlobGetterService) StatManifest(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	return rbs.Stat(rbs.contextForManifestResolution(ctx), dgst)
+}
+
+// OpenManifest is the Open counterpart to StatManifest; see its doc comment.
+func (rbs *remoteBlobGetterService) OpenManifest(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	return rbs.Open(rbs.contextForManifestResolution(ctx), dgst)
+}
+
+// ServeManifestBlob is the ServeBlob counterpart to StatManifest; see its doc comment.
+func (rbs *remoteBlobGetterService) ServeManifestBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
+	return rbs.ServeBlob(rbs.contextForManifestResolution(ctx), w, req, dgst)
+}
+
+func (rbs *remoteBlobGetterService) maxCandidateProbeWorkers() int {
+	if rbs.candidateProbeWorkers > 0 {
+		return rbs.candidateProbeWorkers
+	}
+	return defaultCandidateProbeWorkers
 }
 
 var _ BlobGetterService = &remoteBlobGetterService{}
@@ -44,10 +145,9 @@ func (rbs *remoteBlobGetterService) Stat(ctx context.Context, dgst digest.Digest
 		return distribution.Descriptor{}, err
 	}
 
-	rbs.pullFromInsecureRegistries = false
-
+	var pullFromInsecureRegistries bool
 	if insecure, ok := is.Annotations[imageapi.InsecureRepositoryAnnotation]; ok {
-		rbs.pullFromInsecureRegistries = insecure == "true"
+		pullFromInsecureRegistries = insecure == "true"
 	}
 
 	var localRegistry string
@@ -57,29 +157,75 @@ func (rbs *remoteBlobGetterService) Stat(ctx context.Context, dgst digest.Digest
 	}
 
 	retriever := rbs.repo.importContext()
-	cached := rbs.repo.cachedLayers.RepositoriesForDigest(dgst)
+	cached := rbs.cachedLayersForDigest(ctx, dgst)
 
 	// look at the first level of tagged repositories first
 	search := rbs.identifyCandidateRepositories(is, localRegistry, true)
-	if desc, err := rbs.findCandidateRepository(ctx, search, cached, dgst, retriever); err == nil {
-		return desc, nil
-	}
-
 	// look at all other repositories tagged by the server
 	secondary := rbs.identifyCandidateRepositories(is, localRegistry, false)
 	for k := range search {
 		delete(secondary, k)
 	}
-	if desc, err := rbs.findCandidateRepository(ctx, secondary, cached, dgst, retriever); err == nil {
+
+	isLive := func(repo string) bool {
+		_, inSearch := search[repo]
+		_, inSecondary := secondary[repo]
+		return inSearch || inSecondary
+	}
+
+	if desc, err := rbs.findCandidateRepository(ctx, search, cached, dgst, retriever, pullFromInsecureRegistries, isLive); err == nil {
+		return desc, nil
+	}
+
+	if desc, err := rbs.findCandidateRepository(ctx, secondary, cached, dgst, retriever, pullFromInsecureRegistries, isLive); err == nil {
 		return desc, nil
 	}
 
 	return distribution.Descriptor{}, distribution.ErrBlobUnknown
 }
 
-func (rbs *remoteBlobGetterService) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+// cachedLayersForDigest returns the repositories previously known to hold dgst, consulting the
+// persistent BlobSourceStore (if configured) before the in-memory cachedLayers TTL cache so a cold
+// registry restart doesn't force every Stat to re-scan every candidate repository.
+func (rbs *remoteBlobGetterService) cachedLayersForDigest(ctx context.Context, dgst digest.Digest) []string {
+	var repos []string
+	seen := make(map[string]struct{})
+
+	if rbs.sourceStore != nil {
+		entries, err := rbs.sourceStore.Repositories(ctx, dgst)
+		if err != nil {
+			context.GetLogger(ctx).Errorf("blobsourcestore: failed to look up %q: %v", dgst, err)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].LastSeen.After(entries[j].LastSeen) })
+		for _, entry := range entries {
+			if _, ok := seen[entry.Repository]; ok {
+				continue
+			}
+			seen[entry.Repository] = struct{}{}
+			repos = append(repos, entry.Repository)
+		}
+	}
+
+	for _, repo := range rbs.repo.cachedLayers.RepositoriesForDigest(dgst) {
+		if _, ok := seen[repo]; ok {
+			continue
+		}
+		seen[repo] = struct{}{}
+		repos = append(repos, repo)
+	}
+
+	return repos
+}
+
+func (rbs *remoteBlobGetterService) storeFor(dgst digest.Digest) (distribution.BlobStore, bool) {
+	rbs.storeMu.Lock()
+	defer rbs.storeMu.Unlock()
 	store, ok := rbs.digestToStore[dgst.String()]
-	if ok {
+	return store, ok
+}
+
+func (rbs *remoteBlobGetterService) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	if store, ok := rbs.storeFor(dgst); ok {
 		return store.Open(ctx, dgst)
 	}
 
@@ -89,7 +235,7 @@ func (rbs *remoteBlobGetterService) Open(ctx context.Context, dgst digest.Digest
 		return nil, err
 	}
 
-	store, ok = rbs.digestToStore[desc.Digest.String()]
+	store, ok := rbs.storeFor(desc.Digest)
 	if !ok {
 		return nil, distribution.ErrBlobUnknown
 	}
@@ -98,8 +244,7 @@ func (rbs *remoteBlobGetterService) Open(ctx context.Context, dgst digest.Digest
 }
 
 func (rbs *remoteBlobGetterService) ServeBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
-	store, ok := rbs.digestToStore[dgst.String()]
-	if ok {
+	if store, ok := rbs.storeFor(dgst); ok {
 		return store.ServeBlob(ctx, w, req, dgst)
 	}
 
@@ -109,7 +254,7 @@ func (rbs *remoteBlobGetterService) ServeBlob(ctx context.Context, w http.Respon
 		return err
 	}
 
-	store, ok = rbs.digestToStore[desc.Digest.String()]
+	store, ok := rbs.storeFor(desc.Digest)
 	if !ok {
 		return distribution.ErrBlobUnknown
 	}
@@ -118,18 +263,31 @@ func (rbs *remoteBlobGetterService) ServeBlob(ctx context.Context, w http.Respon
 }
 
 // proxyStat attempts to locate the digest in the provided remote repository or returns an error. If the digest is found,
-// rbs.digestToStore saves the store.
-func (rbs *remoteBlobGetterService) proxyStat(ctx context.Context, retriever importer.RepositoryRetriever, ref imageapi.DockerImageReference, dgst digest.Digest) (distribution.Descriptor, error) {
+// rbs.digestToStore saves the store. pullFromInsecureRegistries is passed in by the caller rather than read off rbs,
+// since Stat now probes candidates concurrently and the setting is derived once per Stat call.
+func (rbs *remoteBlobGetterService) proxyStat(ctx context.Context, retriever importer.RepositoryRetriever, ref imageapi.DockerImageReference, dgst digest.Digest, pullFromInsecureRegistries bool) (distribution.Descriptor, error) {
 	context.GetLogger(ctx).Infof("Trying to stat %q from %q", dgst, ref.Exact())
 
 	ctx = WithRemoteBlobGetter(ctx, rbs)
 
-	repo, err := retriever.Repository(ctx, ref.RegistryURL(), ref.RepositoryName(), rbs.pullFromInsecureRegistries)
+	repo, err := retriever.Repository(ctx, ref.RegistryURL(), ref.RepositoryName(), pullFromInsecureRegistries)
 	if err != nil {
 		context.GetLogger(ctx).Errorf("error getting remote repository for image %q: %v", ref.Exact(), err)
 		return distribution.Descriptor{}, err
 	}
 
+	// If the caller explicitly attached a PlatformSelector (i.e. it is resolving a manifest or tag
+	// digest that might be a manifest list), resolve it to the matching child manifest before
+	// statting it. This must stay opt-in: proxyStat is also the hot path for every ordinary layer
+	// blob probe, and unconditionally doing an extra Manifests().Get() round trip here would double
+	// the RTT of the common case. Callers resolving manifests should attach a selector via
+	// WithPlatformSelector or contextForManifestResolution before calling Stat/Open/ServeBlob.
+	if sel, ok := PlatformSelectorFrom(ctx); ok {
+		if child, ok := rbs.resolvePlatformManifest(ctx, repo, dgst, sel); ok {
+			dgst = child
+		}
+	}
+
 	bs := repo.Blobs(ctx)
 
 	desc, err := bs.Stat(ctx, dgst)
@@ -140,15 +298,30 @@ func (rbs *remoteBlobGetterService) proxyStat(ctx context.Context, retriever imp
 		return distribution.Descriptor{}, err
 	}
 
+	rbs.storeMu.Lock()
 	rbs.digestToStore[dgst.String()] = bs
+	rbs.storeMu.Unlock()
+
+	if rbs.scheduler != nil {
+		rbs.scheduler.addBlob(ctx, dgst, rbs.blobTTL)
+	}
 
 	return desc, nil
 }
 
+// rememberManifestPull queues dgst for eviction once its TTL expires. It
+// should be called by the manifest handler whenever a manifest is resolved
+// through pull-through rather than served from local storage.
+func (rbs *remoteBlobGetterService) rememberManifestPull(ctx context.Context, dgst digest.Digest) {
+	if rbs.scheduler == nil {
+		return
+	}
+	rbs.scheduler.addManifest(ctx, dgst, rbs.blobTTL)
+}
+
 // Get attempts to fetch the requested blob by digest using a remote proxy store if necessary.
 func (rbs *remoteBlobGetterService) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
-	store, ok := rbs.digestToStore[dgst.String()]
-	if ok {
+	if store, ok := rbs.storeFor(dgst); ok {
 		return store.Get(ctx, dgst)
 	}
 
@@ -158,7 +331,7 @@ func (rbs *remoteBlobGetterService) Get(ctx context.Context, dgst digest.Digest)
 		return nil, err
 	}
 
-	store, ok = rbs.digestToStore[desc.Digest.String()]
+	store, ok := rbs.storeFor(desc.Digest)
 	if !ok {
 		return nil, distribution.ErrBlobUnknown
 	}
@@ -166,8 +339,10 @@ func (rbs *remoteBlobGetterService) Get(ctx context.Context, dgst digest.Digest)
 	return store.Get(ctx, desc.Digest)
 }
 
-// findCandidateRepository looks in search for a particular blob, referring to previously cached items
-func (rbs *remoteBlobGetterService) findCandidateRepository(ctx context.Context, search map[string]*imageapi.DockerImageReference, cachedLayers []string, dgst digest.Digest, retriever importer.RepositoryRetriever) (distribution.Descriptor, error) {
+// findCandidateRepository looks in search for a particular blob, referring to previously cached items. Within
+// each phase (cached repositories, then the remaining search set) candidates are probed concurrently, bounded
+// by maxCandidateProbeWorkers, and the first successful proxyStat cancels the rest.
+func (rbs *remoteBlobGetterService) findCandidateRepository(ctx context.Context, search map[string]*imageapi.DockerImageReference, cachedLayers []string, dgst digest.Digest, retriever importer.RepositoryRetriever, pullFromInsecureRegistries bool, isLive isRepositoryLiveFunc) (distribution.Descriptor, error) {
 	// no possible remote locations to search, exit early
 	if len(search) == 0 {
 		return distribution.Descriptor{}, distribution.ErrBlobUnknown
@@ -175,34 +350,99 @@ func (rbs *remoteBlobGetterService) findCandidateRepository(ctx context.Context,
 
 	// see if any of the previously located repositories containing this digest are in this
 	// image stream
+	cachedRefs := make(map[string]*imageapi.DockerImageReference)
 	for _, repo := range cachedLayers {
-		ref, ok := search[repo]
-		if !ok {
-			continue
-		}
-		desc, err := rbs.proxyStat(ctx, retriever, *ref, dgst)
-		if err != nil {
-			delete(search, repo)
-			continue
+		if ref, ok := search[repo]; ok {
+			cachedRefs[repo] = ref
 		}
-		context.GetLogger(ctx).Infof("Found digest location from cache %q in %q", dgst, repo)
+	}
+	if desc, ok := rbs.probeCandidates(ctx, cachedRefs, dgst, retriever, pullFromInsecureRegistries, true, isLive); ok {
 		return desc, nil
 	}
 
 	// search the remaining registries for this digest
+	remaining := make(map[string]*imageapi.DockerImageReference, len(search))
 	for repo, ref := range search {
-		desc, err := rbs.proxyStat(ctx, retriever, *ref, dgst)
-		if err != nil {
+		if _, ok := cachedRefs[repo]; ok {
 			continue
 		}
-		rbs.repo.cachedLayers.RememberDigest(dgst, rbs.repo.blobrepositorycachettl, repo)
-		context.GetLogger(ctx).Infof("Found digest location by search %q in %q", dgst, repo)
+		remaining[repo] = ref
+	}
+	if desc, ok := rbs.probeCandidates(ctx, remaining, dgst, retriever, pullFromInsecureRegistries, false, isLive); ok {
 		return desc, nil
 	}
 
 	return distribution.Descriptor{}, distribution.ErrBlobUnknown
 }
 
+// probeCandidates fans proxyStat calls out across refs using a bounded worker pool, cancelling the remaining
+// probes as soon as one succeeds. When fromCache is false, a successful match is remembered via
+// cachedLayers.RememberDigest so future Stat calls for this digest try it first.
+func (rbs *remoteBlobGetterService) probeCandidates(ctx context.Context, refs map[string]*imageapi.DockerImageReference, dgst digest.Digest, retriever importer.RepositoryRetriever, pullFromInsecureRegistries bool, fromCache bool, isLive isRepositoryLiveFunc) (distribution.Descriptor, bool) {
+	if len(refs) == 0 {
+		return distribution.Descriptor{}, false
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type probeResult struct {
+		repo string
+		desc distribution.Descriptor
+		err  error
+	}
+
+	results := make(chan probeResult, len(refs))
+	sem := make(chan struct{}, rbs.maxCandidateProbeWorkers())
+
+	var wg sync.WaitGroup
+	for repo, ref := range refs {
+		wg.Add(1)
+		go func(repo string, ref *imageapi.DockerImageReference) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results <- probeResult{repo: repo, err: ctx.Err()}
+				return
+			}
+			defer func() { <-sem }()
+
+			desc, err := rbs.proxyStat(ctx, retriever, *ref, dgst, pullFromInsecureRegistries)
+			results <- probeResult{repo: repo, desc: desc, err: err}
+		}(repo, ref)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for res := range results {
+		if res.err != nil {
+			continue
+		}
+
+		cancel()
+
+		if fromCache {
+			context.GetLogger(ctx).Infof("Found digest location from cache %q in %q", dgst, res.repo)
+		} else {
+			rbs.repo.cachedLayers.RememberDigest(dgst, rbs.repo.blobrepositorycachettl, res.repo)
+			context.GetLogger(ctx).Infof("Found digest location by search %q in %q", dgst, res.repo)
+		}
+		if rbs.sourceStore != nil {
+			if err := rbs.sourceStore.Record(ctx, dgst, res.repo, pullFromInsecureRegistries, isLive); err != nil {
+				context.GetLogger(ctx).Errorf("blobsourcestore: failed to record %q in %q: %v", dgst, res.repo, err)
+			}
+		}
+		return res.desc, true
+	}
+
+	return distribution.Descriptor{}, false
+}
+
 // identifyCandidateRepositories returns a map of remote repositories referenced by this image stream.
 func (rbs *remoteBlobGetterService) identifyCandidateRepositories(is *imageapi.ImageStream, localRegistry string, primary bool) map[string]*imageapi.DockerImageReference {
 	// identify the canonical location of referenced registries to search
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// schedulerAction identifies what should happen to an entry once its TTL fires.
+type schedulerAction string
+
+const (
+	// blobDelete removes a layer link from the local repository that proxied
+	// it; the underlying blob data is not deleted.
+	blobDelete schedulerAction = "blobDelete"
+	// manifestDelete removes a pulled-through manifest from local storage.
+	manifestDelete schedulerAction = "manifestDelete"
+
+	// defaultSchedulerFlushInterval controls how often the in-memory queue is
+	// persisted to the storage driver.
+	defaultSchedulerFlushInterval = 5 * time.Minute
+)
+
+// onTTLExpiryFunc is invoked when an entry's TTL fires. Implementations are
+// expected to remove the referenced digest from local storage.
+type onTTLExpiryFunc func(dgst digest.Digest, action schedulerAction) error
+
+// schedulerEntry is a single queued expiration, persisted as part of the
+// scheduler's state file.
+type schedulerEntry struct {
+	Digest digest.Digest   `json:"digest"`
+	Action schedulerAction `json:"action"`
+	Expiry time.Time       `json:"expiry"`
+
+	ttl   time.Duration
+	timer *time.Timer
+	// generation is bumped every time this entry's TTL is refreshed. A fired
+	// timer compares the generation it was scheduled with against the entry's
+	// current generation to detect whether it was superseded by a refresh
+	// that raced with the fire, so a stale fire can no-op instead of either
+	// evicting a just-refreshed entry or double-firing the callback.
+	generation uint64
+}
+
+// pullThroughScheduler queues blobs and manifests served via pull-through for
+// eventual removal from local storage once their TTL expires. It survives
+// registry restarts by periodically flushing its queue to a JSON file via the
+// storage driver.
+type pullThroughScheduler struct {
+	driver       storagedriver.StorageDriver
+	pathToState  string
+	startupDelay time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*schedulerEntry
+	onBlob  onTTLExpiryFunc
+	stopped bool
+	stopCh  chan struct{}
+}
+
+// newPullThroughScheduler creates a scheduler that persists its state to
+// pathToState using driver. Callers must invoke onExpiry before start.
+func newPullThroughScheduler(driver storagedriver.StorageDriver, pathToState string, startupDelay time.Duration) *pullThroughScheduler {
+	return &pullThroughScheduler{
+		driver:       driver,
+		pathToState:  pathToState,
+		startupDelay: startupDelay,
+		entries:      make(map[string]*schedulerEntry),
+	}
+}
+
+// onExpiry registers the callback invoked when an entry's TTL fires.
+func (s *pullThroughScheduler) onExpiry(fn onTTLExpiryFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onBlob = fn
+}
+
+// start loads any previously persisted entries and begins scheduling their
+// remaining TTLs. Entries that already expired while the registry was down
+// are fired after startupDelay, to avoid a thundering herd of deletions on
+// restart.
+func (s *pullThroughScheduler) start(ctx context.Context) error {
+	if err := s.restore(ctx); err != nil {
+		context.GetLogger(ctx).Errorf("scheduler: failed to restore state from %q: %v", s.pathToState, err)
+	}
+
+	s.mu.Lock()
+	s.stopCh = make(chan struct{})
+	for _, entry := range s.entries {
+		s.scheduleLocked(entry)
+	}
+	s.mu.Unlock()
+
+	go s.periodicFlush(s.stopCh)
+	return nil
+}
+
+// periodicFlush persists the queue every defaultSchedulerFlushInterval, in addition to the flush
+// that add and fire already do on every change to the queue.
+func (s *pullThroughScheduler) periodicFlush(stopCh chan struct{}) {
+	ticker := time.NewTicker(defaultSchedulerFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			err := s.flushLocked()
+			s.mu.Unlock()
+			if err != nil {
+				context.GetLogger(context.Background()).Errorf("scheduler: periodic flush failed: %v", err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// stop cancels all pending timers without removing persisted state.
+func (s *pullThroughScheduler) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	if s.stopCh != nil {
+		close(s.stopCh)
+		s.stopCh = nil
+	}
+	for _, entry := range s.entries {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+	}
+}
+
+// addBlob enqueues dgst for deletion after ttl, or refreshes the TTL if the
+// digest is already queued.
+func (s *pullThroughScheduler) addBlob(ctx context.Context, dgst digest.Digest, ttl time.Duration) {
+	s.add(ctx, dgst, blobDelete, ttl)
+}
+
+// addManifest enqueues dgst for deletion after ttl, or refreshes the TTL if
+// the digest is already queued.
+func (s *pullThroughScheduler) addManifest(ctx context.Context, dgst digest.Digest, ttl time.Duration) {
+	s.add(ctx, dgst, manifestDelete, ttl)
+}
+
+// add coalesces duplicate entries for the same digest and action, refreshing
+// the TTL on repeat access rather than queuing a second timer.
+func (s *pullThroughScheduler) add(ctx context.Context, dgst digest.Digest, action schedulerAction, ttl time.Duration) {
+	key := entryKey(dgst, action)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+
+	if entry, ok := s.entries[key]; ok {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+		entry.ttl = ttl
+		entry.Expiry = time.Now().Add(ttl)
+		entry.generation++
+		s.scheduleLocked(entry)
+
+		if err := s.flushLocked(); err != nil {
+			context.GetLogger(ctx).Errorf("scheduler: failed to persist state: %v", err)
+		}
+		return
+	}
+
+	entry := &schedulerEntry{
+		Digest: dgst,
+		Action: action,
+		Expiry: time.Now().Add(ttl),
+		ttl:    ttl,
+	}
+	s.entries[key] = entry
+	s.scheduleLocked(entry)
+
+	if err := s.flushLocked(); err != nil {
+		context.GetLogger(ctx).Errorf("scheduler: failed to persist state: %v", err)
+	}
+}
+
+// scheduleLocked starts (or restarts) the timer for entry. Callers must hold s.mu. The timer
+// closes over entry's generation at schedule time, so a later refresh that bumps the generation
+// makes this particular firing stale without needing to cancel it first.
+func (s *pullThroughScheduler) scheduleLocked(entry *schedulerEntry) {
+	d := time.Until(entry.Expiry)
+	if d < 0 {
+		d = s.startupDelay
+	}
+	gen := entry.generation
+	entry.timer = time.AfterFunc(d, func() {
+		s.fire(entry.Digest, entry.Action, gen)
+	})
+}
+
+// fire invokes the registered callback for the expired entry and removes it from the queue, unless
+// gen no longer matches the entry's current generation — meaning add() refreshed it after this
+// timer was scheduled but before it won the race for s.mu, so this firing is stale and must not
+// evict or double-fire the callback for the refreshed entry.
+func (s *pullThroughScheduler) fire(dgst digest.Digest, action schedulerAction, gen uint64) {
+	key := entryKey(dgst, action)
+
+	s.mu.Lock()
+	entry, ok := s.entries[key]
+	if !ok || entry.generation != gen {
+		s.mu.Unlock()
+		return
+	}
+	onBlob := s.onBlob
+	delete(s.entries, key)
+	err := s.flushLocked()
+	s.mu.Unlock()
+
+	if err != nil {
+		context.GetLogger(context.Background()).Errorf("scheduler: failed to persist state after firing %q: %v", dgst, err)
+	}
+
+	if onBlob == nil {
+		return
+	}
+	if err := onBlob(dgst, action); err != nil {
+		context.GetLogger(context.Background()).Errorf("scheduler: callback failed for %q (%s): %v", dgst, action, err)
+	}
+}
+
+// flushLocked serializes the current queue to the storage driver. Callers
+// must hold s.mu.
+func (s *pullThroughScheduler) flushLocked() error {
+	if s.driver == nil {
+		return nil
+	}
+
+	entries := make([]*schedulerEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	return s.driver.PutContent(context.Background(), s.pathToState, data)
+}
+
+// restore reads the persisted queue back from the storage driver, if any.
+func (s *pullThroughScheduler) restore(ctx context.Context) error {
+	data, err := s.driver.GetContent(ctx, s.pathToState)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	var entries []*schedulerEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range entries {
+		s.entries[entryKey(entry.Digest, entry.Action)] = entry
+	}
+	return nil
+}
+
+func entryKey(dgst digest.Digest, action schedulerAction) string {
+	return string(action) + ":" + dgst.String()
+}
@@ -0,0 +1,39 @@
+package server
+
+import "time"
+
+const (
+	// defaultSchedulerTTL is how long a pulled-through blob or manifest is
+	// kept in local storage after it was last accessed.
+	defaultSchedulerTTL = 24 * time.Hour
+	// defaultSchedulerStartupDelay bounds how soon, after a restart, entries
+	// that already expired while the registry was down are fired.
+	defaultSchedulerStartupDelay = 1 * time.Minute
+)
+
+// SchedulerConfig controls the pull-through cache eviction scheduler. It is
+// read alongside the other pull-through settings in the registry middleware
+// configuration.
+type SchedulerConfig struct {
+	// Enabled turns on TTL-based eviction of pulled-through blobs and
+	// manifests. Disabled by default for backwards compatibility.
+	Enabled bool
+	// TTL is how long a pulled-through blob or manifest is retained locally
+	// after it was last served before it becomes eligible for eviction.
+	TTL time.Duration
+	// StartupDelay bounds how soon already-expired entries are fired after
+	// the registry restarts, to avoid a thundering herd of deletions.
+	StartupDelay time.Duration
+}
+
+// schedulerConfigWithDefaults fills in zero-valued fields of cfg with the
+// package defaults.
+func schedulerConfigWithDefaults(cfg SchedulerConfig) SchedulerConfig {
+	if cfg.TTL == 0 {
+		cfg.TTL = defaultSchedulerTTL
+	}
+	if cfg.StartupDelay == 0 {
+		cfg.StartupDelay = defaultSchedulerStartupDelay
+	}
+	return cfg
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+)
+
+func newTestScheduler() *pullThroughScheduler {
+	return &pullThroughScheduler{
+		entries: make(map[string]*schedulerEntry),
+	}
+}
+
+// TestSchedulerAddCoalescesDuplicateEntries verifies that repeat add() calls for the same digest
+// and action refresh the existing entry rather than queuing a second one.
+func TestSchedulerAddCoalescesDuplicateEntries(t *testing.T) {
+	s := newTestScheduler()
+	dgst := digest.Digest("sha256:dddd")
+
+	s.add(context.Background(), dgst, blobDelete, time.Hour)
+	s.add(context.Background(), dgst, blobDelete, 2*time.Hour)
+
+	if len(s.entries) != 1 {
+		t.Fatalf("expected exactly one coalesced entry, got %d", len(s.entries))
+	}
+
+	entry := s.entries[entryKey(dgst, blobDelete)]
+	if entry.generation != 1 {
+		t.Errorf("expected generation to be bumped to 1 after refresh, got %d", entry.generation)
+	}
+}
+
+// TestSchedulerFireIgnoresStaleGeneration reproduces the race between a refresh (add) and an
+// in-flight expiry (fire): a fire carrying a generation older than the entry's current generation
+// must be a no-op, not evict the just-refreshed entry or invoke the callback a second time.
+func TestSchedulerFireIgnoresStaleGeneration(t *testing.T) {
+	s := newTestScheduler()
+	dgst := digest.Digest("sha256:eeee")
+
+	s.add(context.Background(), dgst, blobDelete, time.Hour)
+	staleGen := s.entries[entryKey(dgst, blobDelete)].generation
+
+	// Simulate a refresh racing in before the stale timer's fire acquires the lock.
+	s.add(context.Background(), dgst, blobDelete, time.Hour)
+
+	var fired int
+	s.onExpiry(func(digest.Digest, schedulerAction) error {
+		fired++
+		return nil
+	})
+
+	// The stale fire (captured generation from before the refresh) must no-op.
+	s.fire(dgst, blobDelete, staleGen)
+	if fired != 0 {
+		t.Fatalf("stale fire must not invoke the callback, but it fired %d times", fired)
+	}
+	if _, ok := s.entries[entryKey(dgst, blobDelete)]; !ok {
+		t.Fatalf("stale fire must not remove the refreshed entry")
+	}
+
+	// The current generation's fire must still work exactly once.
+	currentGen := s.entries[entryKey(dgst, blobDelete)].generation
+	s.fire(dgst, blobDelete, currentGen)
+	if fired != 1 {
+		t.Fatalf("expected callback to fire exactly once for the current generation, got %d", fired)
+	}
+	if _, ok := s.entries[entryKey(dgst, blobDelete)]; ok {
+		t.Fatalf("expected entry to be removed after a matching-generation fire")
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// schedulerStatePath is where the pull-through eviction scheduler persists its queue.
+const schedulerStatePath = "/dockerregistry/scheduler/state.json"
+
+// newRemoteBlobGetterService builds a remoteBlobGetterService for repo, wiring up the optional
+// pull-through eviction scheduler, persistent blob-source index and platform-list resolver from
+// the given configuration. driver may be nil, in which case scheduling and the persistent source
+// store are both disabled regardless of cfg.
+func newRemoteBlobGetterService(repo *repository, driver storagedriver.StorageDriver, schedCfg SchedulerConfig, sourceStoreMaxPerDigest int, platformCfg PlatformConfig) *remoteBlobGetterService {
+	rbs := &remoteBlobGetterService{
+		repo:            repo,
+		digestToStore:   make(map[string]distribution.BlobStore),
+		manifestLists:   newManifestListResolver(),
+		defaultPlatform: platformCfg.Default,
+	}
+
+	if driver == nil {
+		return rbs
+	}
+
+	rbs.sourceStore = NewBlobSourceStore(driver, sourceStoreMaxPerDigest)
+
+	if schedCfg.Enabled {
+		cfg := schedulerConfigWithDefaults(schedCfg)
+		rbs.blobTTL = cfg.TTL
+		rbs.scheduler = newPullThroughScheduler(driver, schedulerStatePath, cfg.StartupDelay)
+		rbs.scheduler.onExpiry(rbs.evictExpired)
+		if err := rbs.scheduler.start(context.Background()); err != nil {
+			context.GetLogger(context.Background()).Errorf("scheduler: failed to start for %q: %v", repo.Named().Name(), err)
+		}
+	}
+
+	return rbs
+}
+
+// evictExpired is the scheduler callback registered by newRemoteBlobGetterService. It removes the
+// local copy of a pulled-through blob or manifest once its TTL has fired.
+func (rbs *remoteBlobGetterService) evictExpired(dgst digest.Digest, action schedulerAction) error {
+	ctx := context.Background()
+	switch action {
+	case blobDelete:
+		return rbs.deleteLocalBlob(ctx, dgst)
+	case manifestDelete:
+		return rbs.deleteLocalManifest(ctx, dgst)
+	default:
+		return fmt.Errorf("scheduler: unknown action %q for %q", action, dgst)
+	}
+}
+
+// deleteLocalBlob removes the layer link for dgst from the local repository by delegating to the
+// local BlobStore's Delete method (distribution.BlobDeleter), same as the registry's own
+// blob-deletion API uses. It does not check whether other repositories still reference dgst and
+// does not delete the blob data itself.
+func (rbs *remoteBlobGetterService) deleteLocalBlob(ctx context.Context, dgst digest.Digest) error {
+	bs := rbs.repo.Blobs(ctx)
+	deleter, ok := bs.(distribution.BlobDeleter)
+	if !ok {
+		return fmt.Errorf("local blob store for %q does not support deletion", rbs.repo.Named().Name())
+	}
+
+	if err := deleter.Delete(ctx, dgst); err != nil && err != distribution.ErrBlobUnknown {
+		return err
+	}
+
+	rbs.storeMu.Lock()
+	delete(rbs.digestToStore, dgst.String())
+	rbs.storeMu.Unlock()
+
+	return nil
+}
+
+// deleteLocalManifest removes a pulled-through manifest from local storage via the repository's
+// ManifestService, mirroring deleteLocalBlob.
+func (rbs *remoteBlobGetterService) deleteLocalManifest(ctx context.Context, dgst digest.Digest) error {
+	manifests, err := rbs.repo.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := manifests.Delete(ctx, dgst); err != nil && err != distribution.ErrBlobUnknown {
+		return err
+	}
+	return nil
+}